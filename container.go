@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	zen_targets "github.com/zen-io/zen-core/target"
 
@@ -15,29 +19,53 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 )
 
 type DockerContainerConfig struct {
-	Name          string            `mapstructure:"name" zen:"yes" desc:"Name for the target"`
-	Description   string            `mapstructure:"desc" zen:"yes" desc:"Target description"`
-	Labels        []string          `mapstructure:"labels" zen:"yes" desc:"Labels to apply to the targets"` //
-	Deps          []string          `mapstructure:"deps" zen:"yes" desc:"Build dependencies"`
-	PassEnv       []string          `mapstructure:"pass_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are part of the target hash"`
-	PassSecretEnv []string          `mapstructure:"secret_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are not used to calculate the target hash"`
-	Env           map[string]string `mapstructure:"env" zen:"yes" desc:"Key-Value map of static environment variables to be used"`
-	Visibility    []string          `mapstructure:"visibility" zen:"yes" desc:"List of visibility for this target"`
-	Memory        *int              `mapstructure:"memory"`
-	Cpu           *int              `mapstructure:"cpu"`
-	ContainerName string            `mapstructure:"container"`
-	Image         string            `mapstructure:"image"`
-	EnvFiles      []string          `mapstructure:"env_files"`
-	ContainerEnv  map[string]string `mapstructure:"container_env"`
-	Command       string            `mapstructure:"command"`
-	Entrypoint    string            `mapstructure:"entrypoint"`
-	Daemon        bool              `mapstructure:"daemon"`
-	Volumes       map[string]string `mapstructure:"volumes"`
-	Ports         map[string]string `mapstructure:"ports"`
+	Name          string             `mapstructure:"name" zen:"yes" desc:"Name for the target"`
+	Description   string             `mapstructure:"desc" zen:"yes" desc:"Target description"`
+	Labels        []string           `mapstructure:"labels" zen:"yes" desc:"Labels to apply to the targets"` //
+	Deps          []string           `mapstructure:"deps" zen:"yes" desc:"Build dependencies"`
+	PassEnv       []string           `mapstructure:"pass_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are part of the target hash"`
+	PassSecretEnv []string           `mapstructure:"secret_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are not used to calculate the target hash"`
+	Env           map[string]string  `mapstructure:"env" zen:"yes" desc:"Key-Value map of static environment variables to be used"`
+	Visibility    []string           `mapstructure:"visibility" zen:"yes" desc:"List of visibility for this target"`
+	Memory        *int               `mapstructure:"memory"`
+	Cpu           *int               `mapstructure:"cpu"`
+	ContainerName string             `mapstructure:"container"`
+	Image         string             `mapstructure:"image"`
+	EnvFiles      []string           `mapstructure:"env_files"`
+	ContainerEnv  map[string]string  `mapstructure:"container_env"`
+	Command       string             `mapstructure:"command"`
+	Entrypoint    string             `mapstructure:"entrypoint"`
+	Daemon        bool               `mapstructure:"daemon"`
+	Volumes       map[string]string  `mapstructure:"volumes"`
+	Ports         map[string]string  `mapstructure:"ports"`
+	Mirrors       []string           `mapstructure:"mirrors"`
+	RegistryAuth  *RegistryAuth      `mapstructure:"registry_auth"`
+	Healthcheck   *HealthcheckConfig `mapstructure:"healthcheck"`
+}
+
+// HealthcheckConfig describes how to decide a deployed container is ready.
+type HealthcheckConfig struct {
+	Cmd         []string      `mapstructure:"cmd"`
+	HttpGet     *HttpGetProbe `mapstructure:"http_get"`
+	Tcp         *TcpProbe     `mapstructure:"tcp"`
+	Interval    *string       `mapstructure:"interval"`
+	Timeout     *string       `mapstructure:"timeout"`
+	Retries     *int          `mapstructure:"retries"`
+	StartPeriod *string       `mapstructure:"start_period"`
+}
+
+type HttpGetProbe struct {
+	Path string `mapstructure:"path"`
+	Port int    `mapstructure:"port"`
+}
+
+type TcpProbe struct {
+	Port int `mapstructure:"port"`
 }
 
 func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext) ([]*zen_targets.TargetBuilder, error) {
@@ -77,7 +105,12 @@ func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext)
 				if err != nil {
 					return fmt.Errorf("interpolating volume %s: %w", k, err)
 				}
-				cmd = append(cmd, "-v", fmt.Sprintf("%s=%s", interpolatedVolume, v))
+
+				volTarget, opts, err := ParseVolumeOptions(v)
+				if err != nil {
+					return fmt.Errorf("parsing volume %s: %w", v, err)
+				}
+				cmd = append(cmd, "-v", fmt.Sprintf("%s:%s:%s", interpolatedVolume, volTarget, opts.bindSuffix()))
 			}
 
 			if dcc.Entrypoint != "" {
@@ -100,21 +133,18 @@ func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext)
 			}
 			cli.NegotiateAPIVersion(ctx)
 
-			target.SetStatus("Pulling image " + dcc.Image)
-
-			out, err := cli.ImagePull(ctx, dcc.Image, types.ImagePullOptions{})
-			if err != nil {
-				return fmt.Errorf("pulling image: %w", err)
+			if err := pullImageWithMirrors(ctx, cli, target, dcc.Image, dcc.Mirrors, dcc.RegistryAuth); err != nil {
+				return err
 			}
 
-			io.Copy(ioutil.Discard, out)
-			out.Close()
-
 			// Check if the container already exists
 			containerName := dcc.ContainerName
 			_, err = cli.ContainerInspect(ctx, containerName)
 			if err == nil {
-				// Container already exists, do nothing
+				// Container already exists, just make sure it's ready
+				if err := dcc.waitHealthy(ctx, cli, target, containerName); err != nil {
+					return err
+				}
 				target.Debugln("Container %s already exists", containerName)
 				return nil
 			}
@@ -123,10 +153,16 @@ func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext)
 				return fmt.Errorf("computing env for container: %w", err)
 			}
 
+			healthConfig, err := dcc.Healthcheck.dockerConfig()
+			if err != nil {
+				return fmt.Errorf("parsing healthcheck: %w", err)
+			}
+
 			// Container doesn't exist, create a new one
 			config := &container.Config{
-				Image: dcc.Image,
-				Env:   env,
+				Image:       dcc.Image,
+				Env:         env,
+				Healthcheck: healthConfig,
 			}
 			if dcc.Command != "" {
 				config.Cmd = strings.Split(dcc.Command, " ")
@@ -143,14 +179,15 @@ func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext)
 			hostConfig := &container.HostConfig{
 				PortBindings: ports,
 				Mounts:       []mount.Mount{},
+				Binds:        []string{},
 				Resources:    container.Resources{},
 			}
 
 			if dcc.Memory != nil {
-				hostConfig.Resources.Memory = (int64(*dcc.Memory)*1000000)			
+				hostConfig.Resources.Memory = (int64(*dcc.Memory) * 1000000)
 			}
 			if dcc.Cpu != nil {
-				hostConfig.Resources.NanoCPUs = (int64(*dcc.Cpu)*1000000000)			
+				hostConfig.Resources.NanoCPUs = (int64(*dcc.Cpu) * 1000000000)
 			}
 
 			for k, v := range dcc.Volumes {
@@ -158,10 +195,27 @@ func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext)
 				if err != nil {
 					return fmt.Errorf("interpolating volume %s: %w", k, err)
 				}
+
+				volTarget, opts, err := ParseVolumeOptions(v)
+				if err != nil {
+					return fmt.Errorf("parsing volume %s: %w", v, err)
+				}
+
+				if opts.Relabel != "" {
+					// mount.Mount has no SELinux relabel field; :z/:Z only works via Binds.
+					bind := fmt.Sprintf("%s:%s:%s", interpolatedVolume, volTarget, opts.bindSuffix())
+					hostConfig.Binds = append(hostConfig.Binds, bind)
+					continue
+				}
+
 				hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
-					Type:   mount.TypeBind,
-					Source: interpolatedVolume,
-					Target: v,
+					Type:     mount.TypeBind,
+					Source:   interpolatedVolume,
+					Target:   volTarget,
+					ReadOnly: opts.ReadOnly,
+					BindOptions: &mount.BindOptions{
+						CreateMountpoint: true,
+					},
 				})
 			}
 
@@ -178,15 +232,215 @@ func (dcc DockerContainerConfig) GetTargets(_ *zen_targets.TargetConfigContext)
 				return fmt.Errorf("starting container: %w", err)
 			}
 
+			if err := dcc.waitHealthy(ctx, cli, target, containerName); err != nil {
+				return err
+			}
+
 			target.Debugln("Container %s created and started", containerName)
 
 			return nil
 		},
 	}
 
+	t.Scripts["stop"] = &zen_targets.TargetBuilderScript{
+		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
+			ctx := context.Background()
+			cli, err := client.NewClientWithOpts(client.FromEnv)
+			if err != nil {
+				return fmt.Errorf("creating docker client: %w", err)
+			}
+			cli.NegotiateAPIVersion(ctx)
+
+			target.SetStatus("Stopping container " + dcc.ContainerName)
+			if err := cli.ContainerStop(ctx, dcc.ContainerName, container.StopOptions{}); err != nil {
+				return fmt.Errorf("stopping container: %w", err)
+			}
+
+			if argsContain(runCtx.Args, "--rm") {
+				target.SetStatus("Removing container " + dcc.ContainerName)
+				if err := cli.ContainerRemove(ctx, dcc.ContainerName, types.ContainerRemoveOptions{}); err != nil {
+					return fmt.Errorf("removing container: %w", err)
+				}
+			}
+
+			target.Debugln("Container %s stopped", dcc.ContainerName)
+			return nil
+		},
+	}
+
+	t.Scripts["restart"] = &zen_targets.TargetBuilderScript{
+		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
+			ctx := context.Background()
+			cli, err := client.NewClientWithOpts(client.FromEnv)
+			if err != nil {
+				return fmt.Errorf("creating docker client: %w", err)
+			}
+			cli.NegotiateAPIVersion(ctx)
+
+			target.SetStatus("Restarting container " + dcc.ContainerName)
+			if err := cli.ContainerRestart(ctx, dcc.ContainerName, container.StopOptions{}); err != nil {
+				return fmt.Errorf("restarting container: %w", err)
+			}
+
+			target.Debugln("Container %s restarted", dcc.ContainerName)
+			return nil
+		},
+	}
+
+	t.Scripts["logs"] = &zen_targets.TargetBuilderScript{
+		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
+			ctx := context.Background()
+			cli, err := client.NewClientWithOpts(client.FromEnv)
+			if err != nil {
+				return fmt.Errorf("creating docker client: %w", err)
+			}
+			cli.NegotiateAPIVersion(ctx)
+
+			follow, tail := parseLogsArgs(runCtx.Args)
+
+			out, err := cli.ContainerLogs(ctx, dcc.ContainerName, types.ContainerLogsOptions{
+				ShowStdout: true,
+				ShowStderr: true,
+				Follow:     follow,
+				Tail:       tail,
+			})
+			if err != nil {
+				return fmt.Errorf("getting container logs: %w", err)
+			}
+			defer out.Close()
+
+			_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, out)
+			return err
+		},
+	}
+
+	t.Scripts["exec"] = &zen_targets.TargetBuilderScript{
+		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
+			ctx := context.Background()
+			cli, err := client.NewClientWithOpts(client.FromEnv)
+			if err != nil {
+				return fmt.Errorf("creating docker client: %w", err)
+			}
+			cli.NegotiateAPIVersion(ctx)
+
+			execConfig := parseExecArgs(runCtx.Args)
+
+			execCreate, err := cli.ContainerExecCreate(ctx, dcc.ContainerName, execConfig)
+			if err != nil {
+				return fmt.Errorf("creating exec: %w", err)
+			}
+
+			attach, err := cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{Tty: true})
+			if err != nil {
+				return fmt.Errorf("attaching exec: %w", err)
+			}
+			defer attach.Close()
+
+			go io.Copy(attach.Conn, os.Stdin)
+			_, err = io.Copy(os.Stdout, attach.Reader)
+			return err
+		},
+	}
+
 	return []*zen_targets.TargetBuilder{t}, nil
 }
 
+func argsContain(args []string, flag string) bool {
+	for _, a := range args {
+		if a == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseLogsArgs(args []string) (follow bool, tail string) {
+	tail = "all"
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--follow":
+			follow = true
+		case strings.HasPrefix(args[i], "--tail="):
+			tail = strings.TrimPrefix(args[i], "--tail=")
+		case args[i] == "--tail" && i+1 < len(args):
+			tail = args[i+1]
+			i++
+		}
+	}
+
+	return follow, tail
+}
+
+func parseExecArgs(args []string) types.ExecConfig {
+	execConfig := types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		Cmd:          []string{"/bin/sh"},
+	}
+
+	cmd := []string{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--privileged":
+			execConfig.Privileged = true
+		case "--user":
+			if i+1 < len(args) {
+				execConfig.User = args[i+1]
+				i++
+			}
+		default:
+			cmd = append(cmd, args[i])
+		}
+	}
+	if len(cmd) > 0 {
+		execConfig.Cmd = cmd
+	}
+
+	return execConfig
+}
+
+type VolumeOptions struct {
+	ReadOnly bool
+	Relabel  string // "", "z" (shared) or "Z" (private) SELinux relabel
+}
+
+func (o VolumeOptions) bindSuffix() string {
+	suffix := "rw"
+	if o.ReadOnly {
+		suffix = "ro"
+	}
+	if o.Relabel != "" {
+		suffix = fmt.Sprintf("%s,%s", suffix, o.Relabel)
+	}
+	return suffix
+}
+
+func ParseVolumeOptions(target string) (string, VolumeOptions, error) {
+	parts := strings.Split(target, ":")
+	path := parts[0]
+	opts := VolumeOptions{}
+
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "ro":
+			opts.ReadOnly = true
+		case "rw":
+			opts.ReadOnly = false
+		case "z":
+			opts.Relabel = "z"
+		case "Z":
+			opts.Relabel = "Z"
+		default:
+			return "", VolumeOptions{}, fmt.Errorf("unknown volume option %q", opt)
+		}
+	}
+
+	return path, opts, nil
+}
+
 func GetPortBindings(ports map[string]string) (m nat.PortMap, err error) {
 	m = nat.PortMap{}
 	for key, value := range ports {
@@ -301,3 +555,160 @@ func GetContainerEnv(target *zen_targets.Target, runCtx *zen_targets.RuntimeCont
 
 	return env, nil
 }
+
+func (hc *HealthcheckConfig) dockerConfig() (*container.HealthConfig, error) {
+	if hc == nil || len(hc.Cmd) == 0 {
+		return nil, nil
+	}
+
+	interval, err := parseDurationOrDefault(hc.Interval, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseDurationOrDefault(hc.Timeout, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	startPeriod, err := parseDurationOrDefault(hc.StartPeriod, 0)
+	if err != nil {
+		return nil, err
+	}
+	retries := 3
+	if hc.Retries != nil {
+		retries = *hc.Retries
+	}
+
+	return &container.HealthConfig{
+		Test:        append([]string{"CMD"}, hc.Cmd...),
+		Interval:    interval,
+		Timeout:     timeout,
+		StartPeriod: startPeriod,
+		Retries:     retries,
+	}, nil
+}
+
+func parseDurationOrDefault(s *string, def time.Duration) (time.Duration, error) {
+	if s == nil {
+		return def, nil
+	}
+	d, err := time.ParseDuration(*s)
+	if err != nil {
+		return 0, fmt.Errorf("parsing duration %q: %w", *s, err)
+	}
+	return d, nil
+}
+
+func (dcc DockerContainerConfig) waitHealthy(ctx context.Context, cli *client.Client, target *zen_targets.Target, containerID string) error {
+	hc := dcc.Healthcheck
+	if hc == nil {
+		return nil
+	}
+
+	startPeriod, err := parseDurationOrDefault(hc.StartPeriod, 0)
+	if err != nil {
+		return err
+	}
+	interval, err := parseDurationOrDefault(hc.Interval, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	retries := 3
+	if hc.Retries != nil {
+		retries = *hc.Retries
+	}
+
+	target.SetStatus("Waiting for container %s to become healthy", dcc.ContainerName)
+
+	deadline := time.Now().Add(startPeriod).Add(interval * time.Duration(retries))
+	for {
+		healthy, err := dcc.probeOnce(ctx, cli, containerID)
+		if err != nil {
+			return err
+		}
+		if healthy {
+			target.Debugln("Container %s is healthy", dcc.ContainerName)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container %s did not become healthy before the deadline", dcc.ContainerName)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (dcc DockerContainerConfig) probeOnce(ctx context.Context, cli *client.Client, containerID string) (bool, error) {
+	hc := dcc.Healthcheck
+
+	if len(hc.Cmd) > 0 {
+		inspect, err := cli.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return false, fmt.Errorf("inspecting container: %w", err)
+		}
+		if inspect.State == nil || inspect.State.Health == nil {
+			return false, nil
+		}
+		return inspect.State.Health.Status == "healthy", nil
+	}
+
+	timeout, err := parseDurationOrDefault(hc.Timeout, 3*time.Second)
+	if err != nil {
+		return false, err
+	}
+
+	if hc.HttpGet != nil {
+		addr, err := resolveHostAddr(dcc.Ports, hc.HttpGet.Port)
+		if err != nil {
+			return false, err
+		}
+
+		httpClient := &http.Client{Timeout: timeout}
+		resp, err := httpClient.Get(fmt.Sprintf("http://%s%s", addr, hc.HttpGet.Path))
+		if err != nil {
+			return false, nil
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 400, nil
+	}
+
+	if hc.Tcp != nil {
+		addr, err := resolveHostAddr(dcc.Ports, hc.Tcp.Port)
+		if err != nil {
+			return false, err
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+		return true, nil
+	}
+
+	return true, nil
+}
+
+func resolveHostAddr(ports map[string]string, containerPort int) (string, error) {
+	for k, v := range ports {
+		key := k
+		if idx := strings.Index(key, "/"); idx != -1 {
+			key = key[:idx]
+		}
+
+		cp, err := strconv.Atoi(key)
+		if err != nil || cp != containerPort {
+			continue
+		}
+
+		hostIP, hostPort := "127.0.0.1", v
+		if idx := strings.Index(v, ":"); idx != -1 {
+			hostIP, hostPort = v[:idx], v[idx+1:]
+		}
+		if hostIP == "0.0.0.0" {
+			hostIP = "127.0.0.1"
+		}
+
+		return fmt.Sprintf("%s:%s", hostIP, hostPort), nil
+	}
+
+	return "", fmt.Errorf("no port binding configured for container port %d", containerPort)
+}
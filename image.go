@@ -1,9 +1,12 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"strings"
 
 	environs "github.com/zen-io/zen-core/environments"
 	zen_targets "github.com/zen-io/zen-core/target"
@@ -11,7 +14,15 @@ import (
 
 	ecr "github.com/awslabs/amazon-ecr-credential-helper/ecr-login"
 	"github.com/chrismellard/docker-credential-acr-env/pkg/credhelper"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
 var (
@@ -20,83 +31,120 @@ var (
 )
 
 type DockerImageConfig struct {
-	Srcs          []string                         `mapstructure:"srcs"`
-	BuildArgs     map[string]string                `mapstructure:"build_args"`
-	Dockerfile    *string                          `mapstructure:"dockerfile"`
-	DockerIgnore  *string                          `mapstructure:"dockerignore"`
-	Image         string                           `mapstructure:"image"`
-	Context       *string                          `mapstructure:"context"`
-	Registry      *string                          `mapstructure:"registry"`
-	Tags          []string                         `mapstructure:"tags"`
-	Platform      *string                          `mapstructure:"platform"`
-	DeployDeps    []string                         `mapstructure:"deploy_deps"`
-	Daemon        bool                             `mapstructure:"daemon"`
-	Buildx        *string                          `mapstructure:"buildx_toolchain"`
-	Crane         *string                          `mapstructure:"crane_toolchain"`
-	Name          string                           `mapstructure:"name" zen:"yes" desc:"Name for the target"`
-	Description   string                           `mapstructure:"desc" zen:"yes" desc:"Target description"`
-	Labels        []string                         `mapstructure:"labels" zen:"yes" desc:"Labels to apply to the targets"` //
-	Deps          []string                         `mapstructure:"deps" zen:"yes" desc:"Build dependencies"`
-	PassEnv       []string                         `mapstructure:"pass_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are part of the target hash"`
-	PassSecretEnv []string                         `mapstructure:"pass_secret_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are not used to calculate the target hash"`
-	Env           map[string]string                `mapstructure:"env" zen:"yes" desc:"Key-Value map of static environment variables to be used"`
-	Visibility    []string                         `mapstructure:"visibility" zen:"yes" desc:"List of visibility for this target"`
-	Environments  map[string]*environs.Environment `mapstructure:"environments" zen:"yes" desc:"Deployment Environments"`
+	Srcs                []string                         `mapstructure:"srcs"`
+	BuildArgs           map[string]string                `mapstructure:"build_args"`
+	Dockerfile          *string                          `mapstructure:"dockerfile"`
+	DockerIgnore        *string                          `mapstructure:"dockerignore"`
+	Image               string                           `mapstructure:"image"`
+	Context             *string                          `mapstructure:"context"`
+	Registry            *string                          `mapstructure:"registry"`
+	Tags                []string                         `mapstructure:"tags"`
+	Platforms           []string                         `mapstructure:"platform"`
+	ManifestAnnotations map[string]string                `mapstructure:"manifest_annotations"`
+	DeployDeps          []string                         `mapstructure:"deploy_deps"`
+	Daemon              bool                             `mapstructure:"daemon"`
+	Builder             *string                          `mapstructure:"builder"`
+	Buildx              *string                          `mapstructure:"buildx_toolchain"`
+	Buildah             *string                          `mapstructure:"buildah_toolchain"`
+	Mirrors             []string                         `mapstructure:"mirrors"`
+	RegistryAuth        *RegistryAuth                    `mapstructure:"registry_auth"`
+	Name                string                           `mapstructure:"name" zen:"yes" desc:"Name for the target"`
+	Description         string                           `mapstructure:"desc" zen:"yes" desc:"Target description"`
+	Labels              []string                         `mapstructure:"labels" zen:"yes" desc:"Labels to apply to the targets"` //
+	Deps                []string                         `mapstructure:"deps" zen:"yes" desc:"Build dependencies"`
+	PassEnv             []string                         `mapstructure:"pass_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are part of the target hash"`
+	PassSecretEnv       []string                         `mapstructure:"pass_secret_env" zen:"yes" desc:"List of environment variable names that will be passed from the OS environment, they are not used to calculate the target hash"`
+	Env                 map[string]string                `mapstructure:"env" zen:"yes" desc:"Key-Value map of static environment variables to be used"`
+	Visibility          []string                         `mapstructure:"visibility" zen:"yes" desc:"List of visibility for this target"`
+	Environments        map[string]*environs.Environment `mapstructure:"environments" zen:"yes" desc:"Deployment Environments"`
 }
 
 func (dic DockerImageConfig) GetTargets(tcc *zen_targets.TargetConfigContext) ([]*zen_targets.TargetBuilder, error) {
 	if dic.Dockerfile == nil {
 		dic.Dockerfile = utils.StringPtr("Dockerfile")
 	}
-	if dic.Platform == nil {
-		dic.Platform = utils.StringPtr("linux/amd64")
+	if len(dic.Platforms) == 0 {
+		dic.Platforms = []string{"linux/amd64"}
 	}
 
-	toolchains := map[string]string{}
-	if dic.Buildx != nil {
-		toolchains["buildx"] = *dic.Buildx
-	} else if val, ok := tcc.KnownToolchains["buildx"]; !ok {
-		return nil, fmt.Errorf("buildx toolchain is not configured")
-	} else {
-		toolchains["buildx"] = val
+	builder := "buildx"
+	if dic.Builder != nil {
+		builder = *dic.Builder
 	}
 
-	if dic.Crane != nil {
-		toolchains["crane"] = *dic.Crane
-	} else {
-		if val, ok := tcc.KnownToolchains["crane"]; !ok {
-			return nil, fmt.Errorf("crane toolchain is not configured")
+	toolchains := map[string]string{}
+	switch builder {
+	case "buildx":
+		if dic.Buildx != nil {
+			toolchains["buildx"] = *dic.Buildx
+		} else if val, ok := tcc.KnownToolchains["buildx"]; !ok {
+			return nil, fmt.Errorf("buildx toolchain is not configured")
+		} else {
+			toolchains["buildx"] = val
+		}
+	case "buildah":
+		if dic.Buildah != nil {
+			toolchains["buildah"] = *dic.Buildah
+		} else if val, ok := tcc.KnownToolchains["buildah"]; !ok {
+			return nil, fmt.Errorf("buildah toolchain is not configured")
 		} else {
-			toolchains["crane"] = val
+			toolchains["buildah"] = val
 		}
+	case "docker":
+		// Built through the docker engine API in-process, no external toolchain needed.
+	default:
+		return nil, fmt.Errorf("unknown builder %q, must be \"buildx\", \"buildah\" or \"docker\"", builder)
 	}
 
 	if len(dic.Tags) == 0 {
 		dic.Tags = []string{"latest"}
 	}
 
+	multiPlatform := len(dic.Platforms) > 1
+
 	t := zen_targets.ToTarget(dic)
 	t.Srcs = map[string][]string{"context": dic.Srcs, "dockerfile": {*dic.Dockerfile}}
-	t.Outs = []string{"image.tar"}
+	if multiPlatform {
+		t.Outs = []string{"image"}
+	} else {
+		t.Outs = []string{"image.tar"}
+	}
 
 	t.Scripts["build"] = &zen_targets.TargetBuilderScript{
 		Deps: dic.Deps,
 		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
 			target.SetStatus("Building image %s:%s", dic.Image, dic.Tags[0])
 
-			var context string
+			var buildCtxDir string
 			if dic.Context != nil {
-				context = filepath.Join(target.Cwd, *dic.Context)
+				buildCtxDir = filepath.Join(target.Cwd, *dic.Context)
 			} else {
-				context = target.Cwd
+				buildCtxDir = target.Cwd
+			}
+
+			if builder == "buildah" {
+				return dic.buildWithBuildah(target, buildCtxDir)
+			}
+			if builder == "docker" {
+				return dic.buildWithDockerAPI(target, buildCtxDir)
 			}
 
 			args := []string{
-				target.Tools["buildx"], "build", context,
-				"--output", fmt.Sprintf("type=docker,dest=%s/image.tar", target.Cwd),
+				target.Tools["buildx"], "build", buildCtxDir,
+				"--platform", strings.Join(dic.Platforms, ","),
 				"--file", target.Srcs["dockerfile"][0],
 			}
 
+			if multiPlatform {
+				// OCI layout directory holding every platform image plus the index; the deploy script pushes it as a manifest list.
+				args = append(args, "--output", fmt.Sprintf("type=oci,dest=%s/image,tar=false", target.Cwd))
+				for k, v := range dic.ManifestAnnotations {
+					args = append(args, "--annotation", fmt.Sprintf("%s=%s", k, v))
+				}
+			} else {
+				args = append(args, "--output", fmt.Sprintf("type=docker,dest=%s/image.tar", target.Cwd))
+			}
+
 			interpolBuildArgs, err := utils.InterpolateMap(dic.BuildArgs, target.Env)
 			if err != nil {
 				return fmt.Errorf("interpolating build args: %w", err)
@@ -127,16 +175,39 @@ func (dic DockerImageConfig) GetTargets(tcc *zen_targets.TargetConfigContext) ([
 			for _, t := range dic.Tags {
 				tags = append(tags, fmt.Sprintf("%s/%s:%s", *dic.Registry, dic.Image, t))
 			}
-			kraneCmd := []string{target.Tools["crane"], "push", filepath.Join(target.Cwd, "image.tar"), tags[0]}
 
-			if err := target.Exec(kraneCmd, "pushing image"); err != nil {
-				return err
-			}
+			if multiPlatform {
+				// crane.Push only takes a single v1.Image, so push the index directly.
+				idx, err := layout.ImageIndexFromPath(filepath.Join(target.Cwd, "image"))
+				if err != nil {
+					return fmt.Errorf("loading image index: %w", err)
+				}
+
+				remoteOpt := remoteAuthOption(dic.RegistryAuth)
+				for _, t := range tags {
+					ref, err := name.ParseReference(t)
+					if err != nil {
+						return fmt.Errorf("parsing tag %s: %w", t, err)
+					}
+					if err := remote.WriteIndex(ref, idx, remoteOpt); err != nil {
+						return fmt.Errorf("pushing manifest list %s: %w", t, err)
+					}
+				}
+			} else {
+				craneOpt := craneAuthOption(dic.RegistryAuth)
+
+				image, err := crane.Load(filepath.Join(target.Cwd, "image.tar"))
+				if err != nil {
+					return fmt.Errorf("loading image.tar: %w", err)
+				}
+				if err := crane.Push(image, tags[0], craneOpt); err != nil {
+					return fmt.Errorf("pushing image: %w", err)
+				}
 
-			for _, t := range tags[1:] {
-				tagCmd := []string{target.Tools["crane"], "tag", tags[0], t}
-				if err := target.Exec(tagCmd, "tagging image"); err != nil {
-					return err
+				for _, t := range tags[1:] {
+					if err := crane.Tag(tags[0], t, craneOpt); err != nil {
+						return fmt.Errorf("tagging image %s: %w", t, err)
+					}
 				}
 			}
 
@@ -148,6 +219,10 @@ func (dic DockerImageConfig) GetTargets(tcc *zen_targets.TargetConfigContext) ([
 	t.Scripts["load"] = &zen_targets.TargetBuilderScript{
 		Alias: []string{"push"},
 		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
+			if multiPlatform {
+				return fmt.Errorf("load does not support multi-platform images, docker can only load a single-platform image")
+			}
+
 			target.SetStatus("Loading image %s:%s to docker", dic.Image, dic.Tags[0])
 
 			tags := []string{}
@@ -165,5 +240,145 @@ func (dic DockerImageConfig) GetTargets(tcc *zen_targets.TargetConfigContext) ([
 		},
 	}
 
+	t.Scripts["pull"] = &zen_targets.TargetBuilderScript{
+		Run: func(target *zen_targets.Target, runCtx *zen_targets.RuntimeContext) error {
+			if dic.Registry == nil {
+				if val, ok := target.Env["DOCKER_REGISTRY"]; !ok {
+					return fmt.Errorf("need to provide a docker registry or a default via DOCKER_REGISTRY env")
+				} else {
+					dic.Registry = utils.StringPtr(val)
+				}
+			}
+
+			ref := fmt.Sprintf("%s/%s:%s", *dic.Registry, dic.Image, dic.Tags[0])
+			refs := append(mirrorRefs(dic.Mirrors, ref), ref)
+
+			var lastErr error
+			for _, r := range refs {
+				target.SetStatus("Pulling image " + r)
+
+				img, err := crane.Pull(r, craneAuthOption(dic.RegistryAuth))
+				if err != nil {
+					if isRetryablePullError(err) {
+						lastErr = err
+						target.Debugln("pulling %s failed, trying next mirror: %s", r, err)
+						continue
+					}
+					return fmt.Errorf("pulling image: %w", err)
+				}
+
+				tag, err := name.NewTag(r)
+				if err != nil {
+					return fmt.Errorf("parsing image reference %s: %w", r, err)
+				}
+
+				if err := tarball.WriteToFile(filepath.Join(target.Cwd, "image.tar"), tag, img); err != nil {
+					return fmt.Errorf("writing image.tar: %w", err)
+				}
+
+				target.SetStatus("Pulled %s", r)
+				return nil
+			}
+
+			return fmt.Errorf("pulling image %s from canonical registry and %d mirror(s): %w", ref, len(dic.Mirrors), lastErr)
+		},
+	}
+
 	return []*zen_targets.TargetBuilder{t}, nil
 }
+
+func (dic DockerImageConfig) buildWithBuildah(target *zen_targets.Target, buildCtxDir string) error {
+	if len(dic.Platforms) > 1 {
+		return fmt.Errorf("builder \"buildah\" does not support multi-platform builds yet, use builder: buildx")
+	}
+
+	img := fmt.Sprintf("localhost/%s:build", dic.Image)
+
+	args := []string{
+		target.Tools["buildah"], "bud",
+		"--file", target.Srcs["dockerfile"][0],
+		"--tag", img,
+		"--iidfile", filepath.Join(target.Cwd, ".iid"),
+	}
+
+	interpolBuildArgs, err := utils.InterpolateMap(dic.BuildArgs, target.Env)
+	if err != nil {
+		return fmt.Errorf("interpolating build args: %w", err)
+	}
+	for k, v := range interpolBuildArgs {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	args = append(args, buildCtxDir)
+
+	if err := target.Exec(args, "buildah bud"); err != nil {
+		return err
+	}
+
+	pushCmd := []string{
+		target.Tools["buildah"], "push", img,
+		fmt.Sprintf("docker-archive:%s/image.tar", target.Cwd),
+	}
+	return target.Exec(pushCmd, "buildah push")
+}
+
+func (dic DockerImageConfig) buildWithDockerAPI(target *zen_targets.Target, buildCtxDir string) error {
+	if len(dic.Platforms) > 1 {
+		return fmt.Errorf("builder \"docker\" does not support multi-platform builds yet, use builder: buildx")
+	}
+
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return fmt.Errorf("creating docker client: %w", err)
+	}
+	cli.NegotiateAPIVersion(ctx)
+
+	buildCtxTar, err := archive.TarWithOptions(buildCtxDir, &archive.TarOptions{})
+	if err != nil {
+		return fmt.Errorf("archiving build context: %w", err)
+	}
+	defer buildCtxTar.Close()
+
+	interpolBuildArgs, err := utils.InterpolateMap(dic.BuildArgs, target.Env)
+	if err != nil {
+		return fmt.Errorf("interpolating build args: %w", err)
+	}
+	buildArgs := map[string]*string{}
+	for k, v := range interpolBuildArgs {
+		val := v
+		buildArgs[k] = &val
+	}
+
+	resp, err := cli.ImageBuild(ctx, buildCtxTar, types.ImageBuildOptions{
+		Dockerfile: target.Srcs["dockerfile"][0],
+		Tags:       []string{dic.Image},
+		BuildArgs:  buildArgs,
+	})
+	if err != nil {
+		return fmt.Errorf("building image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(newDockerStreamer(target), resp.Body); err != nil {
+		return fmt.Errorf("building image: %w", err)
+	}
+
+	saveOut, err := cli.ImageSave(ctx, []string{dic.Image})
+	if err != nil {
+		return fmt.Errorf("saving image: %w", err)
+	}
+	defer saveOut.Close()
+
+	tarFile, err := os.Create(filepath.Join(target.Cwd, "image.tar"))
+	if err != nil {
+		return fmt.Errorf("creating image.tar: %w", err)
+	}
+	defer tarFile.Close()
+
+	if _, err := io.Copy(tarFile, saveOut); err != nil {
+		return fmt.Errorf("saving image: %w", err)
+	}
+
+	return nil
+}
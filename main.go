@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
+	"strings"
 
 	zen_targets "github.com/zen-io/zen-core/target"
 )
@@ -14,28 +14,72 @@ var KnownTargets = zen_targets.TargetCreatorMap{
 	"docker_image":     DockerImageConfig{},
 }
 
+// dockerStreamer decodes the newline-delimited JSON progress stream the
+// docker engine API emits and forwards it to the owning target.
 type dockerStreamer struct {
-	out io.Writer
-	err func(msg string)
+	target *zen_targets.Target
+	buf    []byte
+}
+
+func newDockerStreamer(target *zen_targets.Target) *dockerStreamer {
+	return &dockerStreamer{target: target}
 }
 
 func (ds *dockerStreamer) Write(b []byte) (n int, err error) {
-	for _, line := range bytes.Split(b, []byte("\n")) {
+	ds.buf = append(ds.buf, b...)
+
+	for {
+		idx := bytes.IndexByte(ds.buf, '\n')
+		if idx == -1 {
+			break
+		}
+
+		line := ds.buf[:idx]
+		ds.buf = ds.buf[idx+1:]
 		if len(line) == 0 {
 			continue
 		}
 
-		var data map[string]any
-		if err := json.Unmarshal(line, &data); err != nil {
-			return 0, fmt.Errorf("unmarshalling docker output: %w", err)
+		if err := ds.handleLine(line); err != nil {
+			return len(b), err
 		}
+	}
+
+	return len(b), nil
+}
 
-		if val, ok := data["stream"]; ok {
-			ds.out.Write([]byte(val.(string)))
-		} else if val, ok := data["error"]; ok {
-			return len(b), fmt.Errorf("building error: %s", val.(string))
+func (ds *dockerStreamer) handleLine(line []byte) error {
+	var data map[string]any
+	if jsonErr := json.Unmarshal(line, &data); jsonErr != nil {
+		return fmt.Errorf("unmarshalling docker output: %w", jsonErr)
+	}
+
+	if detail, ok := data["errorDetail"].(map[string]any); ok {
+		return fmt.Errorf("docker error: %v", detail["message"])
+	} else if val, ok := data["error"]; ok {
+		return fmt.Errorf("docker error: %v", val)
+	} else if val, ok := data["stream"]; ok {
+		ds.target.Debugln(strings.TrimRight(val.(string), "\n"))
+	} else if val, ok := data["status"]; ok {
+		if progress, ok := data["progress"]; ok {
+			ds.target.SetStatus("%s %s", val, progress)
+		} else {
+			ds.target.SetStatus("%s", val)
 		}
+	} else if val, ok := data["aux"]; ok {
+		ds.handleAux(val)
 	}
 
-	return len(b), nil
+	return nil
+}
+
+func (ds *dockerStreamer) handleAux(aux any) {
+	auxMap, ok := aux.(map[string]any)
+	if !ok {
+		return
+	}
+
+	if id, ok := auxMap["ID"]; ok {
+		ds.target.Debugln("layer %v", id)
+	}
 }
@@ -0,0 +1,156 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	zen_targets "github.com/zen-io/zen-core/target"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	gcr "github.com/google/go-containerregistry/pkg/authn/google"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+var gcrKeychain authn.Keychain = gcr.Keychain
+
+type RegistryAuth struct {
+	Username *string `mapstructure:"username"`
+	Password *string `mapstructure:"password"`
+}
+
+func dockerKeychain() authn.Keychain {
+	return authn.NewMultiKeychain(authn.DefaultKeychain, amazonKeychain, azureKeychain, gcrKeychain)
+}
+
+func craneAuthOption(auth *RegistryAuth) crane.Option {
+	if auth != nil && auth.Username != nil && auth.Password != nil {
+		return crane.WithAuth(&authn.Basic{Username: *auth.Username, Password: *auth.Password})
+	}
+	return crane.WithAuthFromKeychain(dockerKeychain())
+}
+
+func remoteAuthOption(auth *RegistryAuth) remote.Option {
+	if auth != nil && auth.Username != nil && auth.Password != nil {
+		return remote.WithAuth(&authn.Basic{Username: *auth.Username, Password: *auth.Password})
+	}
+	return remote.WithAuthFromKeychain(dockerKeychain())
+}
+
+func registryAuthHeader(ref string, auth *RegistryAuth) (string, error) {
+	var authenticator authn.Authenticator = authn.Anonymous
+
+	if auth != nil && auth.Username != nil && auth.Password != nil {
+		authenticator = &authn.Basic{Username: *auth.Username, Password: *auth.Password}
+	} else {
+		parsedRef, err := name.ParseReference(ref)
+		if err != nil {
+			return "", fmt.Errorf("parsing image reference %s: %w", ref, err)
+		}
+		resolved, err := dockerKeychain().Resolve(parsedRef.Context())
+		if err != nil {
+			return "", fmt.Errorf("resolving registry credentials for %s: %w", ref, err)
+		}
+		authenticator = resolved
+	}
+
+	cfg, err := authenticator.Authorization()
+	if err != nil {
+		return "", fmt.Errorf("getting registry authorization for %s: %w", ref, err)
+	}
+
+	encoded, err := json.Marshal(types.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	})
+	if err != nil {
+		return "", fmt.Errorf("encoding registry auth for %s: %w", ref, err)
+	}
+
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+func mirrorRefs(mirrors []string, image string) []string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil
+	}
+
+	refs := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		repo := strings.TrimSuffix(mirror, "/") + "/" + ref.Context().RepositoryStr()
+
+		switch r := ref.(type) {
+		case name.Tag:
+			refs = append(refs, repo+":"+r.TagStr())
+		case name.Digest:
+			refs = append(refs, repo+"@"+r.DigestStr())
+		default:
+			refs = append(refs, repo)
+		}
+	}
+	return refs
+}
+
+func isRetryablePullError(err error) bool {
+	if client.IsErrNotFound(err) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, code := range []string{"404", "500", "502", "503", "504"} {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func pullImageWithMirrors(ctx context.Context, cli *client.Client, target *zen_targets.Target, image string, mirrors []string, auth *RegistryAuth) error {
+	refs := append(mirrorRefs(mirrors, image), image)
+
+	var lastErr error
+	for _, ref := range refs {
+		target.SetStatus("Pulling image " + ref)
+
+		authHeader, err := registryAuthHeader(ref, auth)
+		if err != nil {
+			return err
+		}
+
+		out, err := cli.ImagePull(ctx, ref, types.ImagePullOptions{RegistryAuth: authHeader})
+		if err != nil {
+			if isRetryablePullError(err) {
+				lastErr = err
+				target.Debugln("pulling %s failed, trying next mirror: %s", ref, err)
+				continue
+			}
+			return fmt.Errorf("pulling image: %w", err)
+		}
+
+		_, copyErr := io.Copy(newDockerStreamer(target), out)
+		out.Close()
+		if copyErr != nil {
+			if isRetryablePullError(copyErr) {
+				lastErr = copyErr
+				target.Debugln("pulling %s failed, trying next mirror: %s", ref, copyErr)
+				continue
+			}
+			return fmt.Errorf("pulling image: %w", copyErr)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("pulling image %s from canonical registry and %d mirror(s): %w", image, len(mirrors), lastErr)
+}